@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Additional repomap.type values beyond repoTypeRaw and repoTypeGoMod
+// (gomodproxy.go). repoTypeHTTP is an explicit alias for the same plain
+// file-tree mirror repoTypeRaw already implies; both select httpBackend.
+const (
+	repoTypeHTTP = "http"
+	repoTypeGit  = "git"
+	repoTypeOCI  = "oci"
+)
+
+// BackendResponse is the result of a RepoBackend.Fetch call: either the
+// upstream body plus its validators, or NotModified when the caller's
+// conditional headers were honored. Header carries any upstream response
+// headers a caller needs to pass through verbatim (e.g. OCI's
+// WWW-Authenticate challenge).
+type BackendResponse struct {
+	Body          io.ReadCloser
+	StatusCode    int
+	ContentType   string
+	ContentLength int64
+	ETag          string
+	LastModified  string
+	AcceptRanges  bool
+	NotModified   bool
+	Header        http.Header
+}
+
+// RepoBackend abstracts how bytes for a single object move from an upstream
+// repository into the cache, so the on-disk cache layout, singleflight
+// coalescing (fetchGroup) and GC (gc.go) stay agnostic to whether the
+// upstream is a plain HTTP file tree, a git smart-HTTP server, or an OCI
+// registry.
+type RepoBackend interface {
+	// Fetch retrieves path, honoring ifNoneMatch/ifModifiedSince as
+	// conditional request headers when non-empty. The caller must close
+	// Body whenever it is non-nil.
+	Fetch(ctx context.Context, path, ifNoneMatch, ifModifiedSince string) (*BackendResponse, error)
+	// Validators returns path's current etag, last-modified and size
+	// without downloading the body. freshness.go's revalidation path uses
+	// Fetch with conditional headers instead (a 304 there is already as
+	// cheap as a HEAD, and a 200 saves a second round trip for the body);
+	// Validators exists for callers that only need a lightweight metadata
+	// check, e.g. future admin/debug tooling.
+	Validators(ctx context.Context, path string) (etag, lastMod string, size int64, err error)
+}
+
+// backendFor selects the RepoBackend implementation for repoEntry.repoType.
+// Pre-existing rows (repoType "raw", the implicit default before this repo
+// type column existed) and the explicit "http" type both get httpBackend.
+func backendFor(repoEntry *repoMapEntry) RepoBackend {
+	remoteBase := strings.TrimSuffix(repoEntry.baseURL, "/")
+	switch repoEntry.repoType {
+	case repoTypeGit:
+		return &gitBackend{remoteBase: remoteBase}
+	case repoTypeOCI:
+		return &ociBackend{remoteBase: remoteBase}
+	default:
+		return &httpBackend{remoteBase: remoteBase}
+	}
+}
+
+// backendUpstreamError reports a non-2xx upstream response, carrying enough
+// of it (status and headers) that a caller can decide whether to pass it
+// through to the client verbatim, e.g. an OCI registry's 401 challenge.
+type backendUpstreamError struct {
+	statusCode int
+	header     http.Header
+}
+
+func (e *backendUpstreamError) Error() string {
+	return fmt.Sprintf("upstream error: %s", http.StatusText(e.statusCode))
+}
+
+// httpBackend implements RepoBackend for the original plain HTTP file-tree
+// mirror behavior.
+type httpBackend struct {
+	remoteBase string
+}
+
+func (b *httpBackend) url(path string) string {
+	return fmt.Sprintf("%s/%s", b.remoteBase, path)
+}
+
+func (b *httpBackend) Validators(ctx context.Context, path string) (etag, lastMod string, size int64, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, b.url(path), nil)
+	if err != nil {
+		return "", "", 0, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer resp.Body.Close()
+	size, _ = strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	return resp.Header.Get("Etag"), resp.Header.Get("Last-Modified"), size, nil
+}
+
+func (b *httpBackend) Fetch(ctx context.Context, path, ifNoneMatch, ifModifiedSince string) (*BackendResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.url(path), nil)
+	if err != nil {
+		return nil, err
+	}
+	if ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	if ifModifiedSince != "" {
+		req.Header.Set("If-Modified-Since", ifModifiedSince)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		return &BackendResponse{StatusCode: resp.StatusCode, NotModified: true}, nil
+	}
+
+	contentLength, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	return &BackendResponse{
+		Body:          resp.Body,
+		StatusCode:    resp.StatusCode,
+		ContentType:   resp.Header.Get("Content-Type"),
+		ContentLength: contentLength,
+		ETag:          strings.TrimPrefix(resp.Header.Get("ETag"), "W/"),
+		LastModified:  resp.Header.Get("Last-Modified"),
+		AcceptRanges:  resp.Header.Get("Accept-Ranges") == "bytes",
+		Header:        resp.Header,
+	}, nil
+}
+
+// headInfo augments Validators with the extra detail mainHandler's original
+// unconditional HEAD probe used to have (Content-Type, Accept-Ranges),
+// needed to decide between the chunked-fetch and plain-fetch paths and to
+// set the response's Content-Type ahead of a cache miss.
+type headInfo struct {
+	lastMod       string
+	contentLength int64
+	etag          string
+	contentType   string
+	acceptRanges  bool
+}
+
+// probeHead is an httpBackend-specific superset of Validators: git and OCI
+// upstreams don't support this kind of blind HEAD (and don't need it, since
+// they never chunk a Range fetch), so it isn't part of RepoBackend.
+func (b *httpBackend) probeHead(ctx context.Context, path string) (headInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, b.url(path), nil)
+	if err != nil {
+		return headInfo{}, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return headInfo{}, err
+	}
+	defer resp.Body.Close()
+	contentLength, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	return headInfo{
+		lastMod:       resp.Header.Get("Last-Modified"),
+		contentLength: contentLength,
+		etag:          resp.Header.Get("Etag"),
+		contentType:   resp.Header.Get("Content-Type"),
+		acceptRanges:  resp.Header.Get("Accept-Ranges") == "bytes",
+	}, nil
+}
+
+// fetchAndCacheViaBackend downloads path from backend into cachePath,
+// holding the same per-object flock fetchAndCacheMiss and
+// fetchAndCacheGoModObject use so concurrent repoproxyd processes sharing a
+// cache volume can't write the same entry twice. It reports the response
+// ETag and Content-Type alongside missResult so the caller can set headers
+// without a second Validators round trip. If the lock cannot be acquired in
+// time it returns a non-cached result so the caller can fall back to an
+// uncached pass-through, matching the raw-mirror behavior in repoproxyd.go.
+func fetchAndCacheViaBackend(ctx context.Context, backend RepoBackend, repo, itemPath, cachePath string) (*missResult, string, string, error) {
+	lock, err := acquireObjectLock(cachePath, true)
+	if err != nil {
+		logger.Println("WARN_LOCK_TIMEOUT", err)
+		return &missResult{cached: false}, "", "", nil
+	}
+	defer lock.release()
+
+	if fi, statErr := os.Stat(cachePath); statErr == nil && fi.Size() > 0 {
+		// Another process already populated this entry while we waited.
+		return &missResult{cached: true}, "", "", nil
+	}
+
+	resp, err := backend.Fetch(ctx, itemPath, "", "")
+	if err != nil {
+		return nil, "", "", fmt.Errorf("upstream fetch failed: %w", err)
+	}
+	if resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, "", "", &backendUpstreamError{statusCode: resp.StatusCode, header: resp.Header}
+	}
+	if resp.Body == nil {
+		return nil, "", "", fmt.Errorf("upstream returned no body for %s", itemPath)
+	}
+
+	tmpPath := cachePath + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("failed to create tmp cache file: %w", err)
+	}
+
+	n, err := copyStream(ctx, "cache.write", file, resp.Body, repo, false, resp.StatusCode)
+	if err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return nil, "", "", fmt.Errorf("failed to stream upstream body: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return nil, "", "", fmt.Errorf("failed to close tmp cache file: %w", err)
+	}
+	if err := os.Rename(tmpPath, cachePath); err != nil {
+		os.Remove(tmpPath)
+		return nil, "", "", fmt.Errorf("failed to publish cache file: %w", err)
+	}
+
+	if err := updateCache(ctx, repo, itemPath, resp.LastModified, n, resp.ETag, "", resp.ContentType); err != nil {
+		logger.Println("ERR_UPDATECACHE", err)
+	}
+
+	return &missResult{cached: true}, resp.ETag, resp.ContentType, nil
+}
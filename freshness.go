@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultCacheTTL is used when neither CACHE_TTL nor a per-repo override is
+// set: cache entries younger than this are served without contacting
+// upstream at all.
+const defaultCacheTTL = 5 * time.Minute
+
+// cacheItem mirrors a row of the cacheitem table. sumHash is only populated
+// for gomod .zip entries, holding the verified "h1:..." dirhash so cache
+// hits can re-emit it as the ETag without re-verifying against sumdb.
+// contentType holds the upstream Content-Type observed on the fetch that
+// populated this entry, so a cache hit can re-emit it instead of leaving the
+// response's media type to http.ServeContent's filename-extension sniffing
+// (which guesses wrong for extension-less paths like OCI manifest refs).
+type cacheItem struct {
+	lastMod     string
+	fileSize    int64
+	etag        string
+	sumHash     string
+	contentType string
+	updateDate  time.Time
+}
+
+// getCacheItem looks up the stored validators for repo+itemPath. A missing
+// row (or any scan error) is reported as "not found", matching the loose
+// error handling the rest of the cache-lookup code already uses.
+func getCacheItem(ctx context.Context, repo, itemPath string) (*cacheItem, bool) {
+	var item cacheItem
+	err := db.QueryRow(ctx, "SELECT lastmodified, filesize, etag, COALESCE(sumhash, ''), COALESCE(contenttype, ''), updatedate FROM cacheitem WHERE reponame = $1 AND pathname = $2", repo, itemPath).
+		Scan(&item.lastMod, &item.fileSize, &item.etag, &item.sumHash, &item.contentType, &item.updateDate)
+	if err != nil {
+		return nil, false
+	}
+	return &item, true
+}
+
+// touchCacheUpdateDate bumps updatedate to NOW() without changing the
+// stored validators, used after an upstream revalidation confirms the
+// object is unchanged.
+func touchCacheUpdateDate(ctx context.Context, repo, itemPath string) error {
+	_, err := db.Exec(ctx, "UPDATE cacheitem SET updatedate = NOW() WHERE reponame = $1 AND pathname = $2", repo, itemPath)
+	if err != nil {
+		return fmt.Errorf("failed to touch cacheitem: %w", err)
+	}
+	return nil
+}
+
+// cacheTTLFor resolves the freshness window for a repo: a per-repo
+// repomap.ttlseconds override takes precedence over the CACHE_TTL env var,
+// which itself falls back to defaultCacheTTL.
+func cacheTTLFor(entry *repoMapEntry) time.Duration {
+	if entry.ttlOverride != nil {
+		return time.Duration(*entry.ttlOverride) * time.Second
+	}
+	if v := os.Getenv("CACHE_TTL"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+			return time.Duration(secs) * time.Second
+		}
+	}
+	return defaultCacheTTL
+}
+
+// isFresh reports whether item was last validated against upstream within
+// ttl, meaning upstream does not need to be contacted at all.
+func isFresh(item *cacheItem, ttl time.Duration) bool {
+	return time.Since(item.updateDate) < ttl
+}
+
+// cacheFileCurrent reports whether cachePath still exists on disk and
+// matches the size recorded for it, which is the caller's signal that the
+// cacheitem row and file are still in sync. It's checked both before and
+// after taking the per-object lock: a GC sweep can evict the entry in the
+// gap between those two points, and re-checking under the lock is what
+// catches that race.
+func cacheFileCurrent(cachePath string, wantSize int64) bool {
+	fi, err := os.Stat(cachePath)
+	return err == nil && fi.Size() == wantSize
+}
+
+// quoteEtag adds the surrounding quotes ETag values are required to carry on
+// the wire, unless they're already present.
+func quoteEtag(etag string) string {
+	if etag == "" || strings.HasPrefix(etag, "\"") {
+		return etag
+	}
+	return "\"" + etag + "\""
+}
+
+// setCacheValidatorHeaders emits the downstream-facing ETag, Last-Modified
+// and Cache-Control headers for a served cache entry.
+func setCacheValidatorHeaders(w http.ResponseWriter, etag, lastMod string, ttl time.Duration) {
+	if etag != "" {
+		w.Header().Set("ETag", quoteEtag(etag))
+	}
+	if lastMod != "" {
+		w.Header().Set("Last-Modified", lastMod)
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(ttl.Seconds())))
+}
+
+// clientHasFreshCopy evaluates the incoming If-None-Match / If-Modified-Since
+// request headers against the cache's current validators.
+func clientHasFreshCopy(r *http.Request, etag, lastMod string) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etag != "" {
+		want := quoteEtag(etag)
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(candidate), "W/"))
+			if candidate == "*" || candidate == want {
+				return true
+			}
+		}
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && lastMod != "" {
+		imsTime, err1 := http.ParseTime(ims)
+		lastModTime, err2 := http.ParseTime(lastMod)
+		if err1 == nil && err2 == nil && !lastModTime.After(imsTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveCacheHit emits validator headers for item, short-circuits with a
+// bodyless 304 when the client's copy is already current, and otherwise
+// serves cachePath (honoring Range via serveCacheFile).
+func serveCacheHit(ctx context.Context, w http.ResponseWriter, r *http.Request, repo, cachePath string, item *cacheItem, ttl time.Duration) {
+	setCacheValidatorHeaders(w, item.etag, item.lastMod, ttl)
+	if clientHasFreshCopy(r, item.etag, item.lastMod) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	contentType := item.contentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	serveCacheFile(ctx, w, r, repo, cachePath, item.lastMod, true)
+}
+
+// tryServeCacheHit takes the per-object read lock and serves item via
+// serveCacheHit, reporting whether it actually did so. A lock acquired here
+// re-checks cacheFileCurrent before serving: the caller's own freshness
+// check ran unlocked, so a GC sweep can evict the entry in the gap between
+// that check and this one acquiring the lock. When that happens the lock is
+// released (via defer, which fires on this function's own return) and the
+// caller should fall back to treating it as an ordinary cache miss, the same
+// as if getCacheItem had never found a row.
+func tryServeCacheHit(ctx context.Context, w http.ResponseWriter, r *http.Request, repo, itemPath, cachePath string, item *cacheItem, ttl time.Duration) bool {
+	readLock, lockErr := acquireObjectLock(cachePath, false)
+	if lockErr != nil {
+		logger.Println("WARN_LOCK", lockErr)
+	} else {
+		defer readLock.release()
+		if !cacheFileCurrent(cachePath, item.fileSize) {
+			return false
+		}
+	}
+	cw := &countingResponseWriter{ResponseWriter: w}
+	serveCacheHit(ctx, cw, r, repo, cachePath, item, ttl)
+	recordHit(repo)
+	recordCacheAccess(ctx, repo, itemPath, cw.written)
+	return true
+}
+
+// revalidateUpstream issues a conditional GET through backend carrying
+// item's validators, promoting what used to be an unconditional HEAD once
+// the freshness window has expired. It reports whether upstream confirmed
+// the object is unchanged (304); when it isn't, the response body is
+// drained and discarded so the caller can fall back to the normal
+// full-fetch path.
+func revalidateUpstream(ctx context.Context, backend RepoBackend, itemPath string, item *cacheItem) (unchanged bool, err error) {
+	ifNoneMatch := ""
+	if item.etag != "" {
+		ifNoneMatch = quoteEtag(item.etag)
+	}
+
+	resp, err := backend.Fetch(ctx, itemPath, ifNoneMatch, item.lastMod)
+	if err != nil {
+		return false, fmt.Errorf("revalidation request failed: %w", err)
+	}
+	if resp.Body != nil {
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+	}
+
+	return resp.NotModified, nil
+}
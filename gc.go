@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultGCInterval is used when GC_INTERVAL is unset.
+const defaultGCInterval = 10 * time.Minute
+
+var (
+	hitCount  int64
+	missCount int64
+
+	repoStatsMu sync.Mutex
+	repoStats   = map[string]*repoCounters{}
+)
+
+// repoCounters holds the in-process hit/miss counters for a single repo,
+// reported back through GET /admin/stats.
+type repoCounters struct {
+	hits   int64
+	misses int64
+}
+
+func recordHit(repo string) {
+	atomic.AddInt64(&hitCount, 1)
+	repoStatsMu.Lock()
+	defer repoStatsMu.Unlock()
+	counters(repo).hits++
+}
+
+func recordMiss(repo string) {
+	atomic.AddInt64(&missCount, 1)
+	repoStatsMu.Lock()
+	defer repoStatsMu.Unlock()
+	counters(repo).misses++
+}
+
+// counters returns repoStats[repo], creating it if necessary. Callers must
+// hold repoStatsMu.
+func counters(repo string) *repoCounters {
+	c := repoStats[repo]
+	if c == nil {
+		c = &repoCounters{}
+		repoStats[repo] = c
+	}
+	return c
+}
+
+// countingResponseWriter tracks how many bytes were written to the client so
+// the caller can attribute them to cacheitem.bytes_served.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	written int64
+}
+
+func (c *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(p)
+	c.written += int64(n)
+	return n, err
+}
+
+// recordCacheAccess bumps lastaccess and bytes_served for a served cache
+// entry; it is a best-effort accounting update and only logs on failure.
+func recordCacheAccess(ctx context.Context, repo, itemPath string, bytesServed int64) {
+	_, err := db.Exec(ctx, "UPDATE cacheitem SET lastaccess = NOW(), bytes_served = bytes_served + $1 WHERE reponame = $2 AND pathname = $3", bytesServed, repo, itemPath)
+	if err != nil {
+		logger.Println("ERR_RECORDACCESS", err)
+	}
+}
+
+func gcInterval() time.Duration {
+	if v := os.Getenv("GC_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+	}
+	return defaultGCInterval
+}
+
+// cacheMaxBytes returns the configured total on-disk size ceiling, or 0 if
+// CACHE_MAX_BYTES is unset (meaning no size-based eviction).
+func cacheMaxBytes() int64 {
+	if v := os.Getenv("CACHE_MAX_BYTES"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			return n
+		}
+	}
+	return 0
+}
+
+// cacheMaxAge returns the configured age ceiling, or 0 if CACHE_MAX_AGE is
+// unset (meaning no age-based eviction).
+func cacheMaxAge() time.Duration {
+	if v := os.Getenv("CACHE_MAX_AGE"); v != "" {
+		if days, err := strconv.Atoi(v); err == nil && days > 0 {
+			return time.Duration(days) * 24 * time.Hour
+		}
+	}
+	return 0
+}
+
+// startGCLoop runs runGC on a GC_INTERVAL cadence until ctx is cancelled.
+func startGCLoop(ctx context.Context) {
+	interval := gcInterval()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			result, err := runGC(ctx)
+			if err != nil {
+				logger.Println("ERR_GC", err)
+				continue
+			}
+			logger.Println("INFO_GC_SWEEP", result.EvictedCount, result.FreedBytes)
+		}
+	}
+}
+
+// gcResult reports the outcome of a GC sweep, and is also the JSON body
+// returned by POST /admin/gc.
+type gcResult struct {
+	FreedBytes   int64 `json:"freed_bytes"`
+	EvictedCount int   `json:"evicted_count"`
+}
+
+// evictionCandidate identifies a cacheitem row eligible for eviction.
+type evictionCandidate struct {
+	reponame string
+	pathname string
+	filesize int64
+}
+
+// runGC enforces CACHE_MAX_AGE (delete entries not accessed in N days) and
+// then CACHE_MAX_BYTES (LRU-evict by lastaccess until under the ceiling).
+// Either limit is skipped if its env var is unset.
+func runGC(ctx context.Context) (*gcResult, error) {
+	result := &gcResult{}
+
+	if maxAge := cacheMaxAge(); maxAge > 0 {
+		cutoff := time.Now().Add(-maxAge)
+		rows, err := db.Query(ctx, "SELECT reponame, pathname, filesize FROM cacheitem WHERE lastaccess < $1", cutoff)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query aged cacheitems: %w", err)
+		}
+		var aged []evictionCandidate
+		for rows.Next() {
+			var c evictionCandidate
+			if err := rows.Scan(&c.reponame, &c.pathname, &c.filesize); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan aged cacheitem: %w", err)
+			}
+			aged = append(aged, c)
+		}
+		rows.Close()
+
+		for _, c := range aged {
+			if evictOne(ctx, c) {
+				result.FreedBytes += c.filesize
+				result.EvictedCount++
+			}
+		}
+	}
+
+	if maxBytes := cacheMaxBytes(); maxBytes > 0 {
+		for {
+			total, err := currentCacheBytes(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to compute cache size: %w", err)
+			}
+			if total <= maxBytes {
+				break
+			}
+
+			c, ok, err := oldestCacheItem(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to find LRU cacheitem: %w", err)
+			}
+			if !ok {
+				break
+			}
+
+			if !evictOne(ctx, c) {
+				// Couldn't evict (e.g. lock held elsewhere); don't spin.
+				break
+			}
+			result.FreedBytes += c.filesize
+			result.EvictedCount++
+		}
+	}
+
+	return result, nil
+}
+
+func currentCacheBytes(ctx context.Context) (int64, error) {
+	var total int64
+	err := db.QueryRow(ctx, "SELECT COALESCE(SUM(filesize), 0) FROM cacheitem").Scan(&total)
+	if err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+func oldestCacheItem(ctx context.Context) (evictionCandidate, bool, error) {
+	var c evictionCandidate
+	err := db.QueryRow(ctx, "SELECT reponame, pathname, filesize FROM cacheitem ORDER BY lastaccess ASC LIMIT 1").Scan(&c.reponame, &c.pathname, &c.filesize)
+	if err != nil {
+		return evictionCandidate{}, false, nil
+	}
+	return c, true, nil
+}
+
+// evictOne removes a single cache entry's file and DB row, holding the same
+// per-object lock used by fetchAndCacheMiss so an eviction cannot race with
+// an in-progress fetch or read.
+func evictOne(ctx context.Context, c evictionCandidate) bool {
+	cachePath, err := prepareCacheDir(ctx, c.reponame, c.pathname)
+	if err != nil {
+		logger.Println("ERR_GC_PREPAREPATH", err)
+		return false
+	}
+
+	lock, err := acquireObjectLock(cachePath, true)
+	if err != nil {
+		logger.Println("WARN_GC_LOCK", err)
+		return false
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		logger.Println("ERR_GC_TXSTART", err)
+		lock.release()
+		return false
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "DELETE FROM cacheitem WHERE reponame = $1 AND pathname = $2", c.reponame, c.pathname); err != nil {
+		logger.Println("ERR_GC_DELETE", err)
+		lock.release()
+		return false
+	}
+	if err := tx.Commit(ctx); err != nil {
+		logger.Println("ERR_GC_COMMIT", err)
+		lock.release()
+		return false
+	}
+
+	if err := os.Remove(cachePath); err != nil && !os.IsNotExist(err) {
+		logger.Println("ERR_GC_REMOVEFILE", err)
+	}
+
+	// Release before removing the lock file itself: acquireObjectLock opens
+	// cachePath+".lock" by name, so the file must still exist while this
+	// eviction (or any concurrent waiter on it) holds a flock on it.
+	lock.release()
+	if err := os.Remove(cachePath + ".lock"); err != nil && !os.IsNotExist(err) {
+		logger.Println("ERR_GC_REMOVELOCKFILE", err)
+	}
+
+	return true
+}
+
+// adminGCHandler triggers a synchronous GC sweep on demand.
+func adminGCHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "METHOD NOT ALLOWED", http.StatusMethodNotAllowed)
+		return
+	}
+
+	result, err := runGC(r.Context())
+	if err != nil {
+		logger.Println("ERR_ADMIN_GC", err)
+		http.Error(w, "GC ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		logger.Println("ERR_ADMIN_GC_ENCODE", err)
+	}
+}
+
+// repoStat is the per-repo breakdown reported by GET /admin/stats.
+type repoStat struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+}
+
+// statsResponse is the JSON body returned by GET /admin/stats.
+type statsResponse struct {
+	TotalBytes int64               `json:"total_bytes"`
+	EntryCount int64               `json:"entry_count"`
+	Hits       int64               `json:"hits"`
+	Misses     int64               `json:"misses"`
+	PerRepo    map[string]repoStat `json:"per_repo"`
+}
+
+// adminStatsHandler reports total cache size, entry count, hit/miss
+// counters and a per-repo breakdown.
+func adminStatsHandler(w http.ResponseWriter, r *http.Request) {
+	var totalBytes, entryCount int64
+	err := db.QueryRow(r.Context(), "SELECT COALESCE(SUM(filesize), 0), COUNT(*) FROM cacheitem").Scan(&totalBytes, &entryCount)
+	if err != nil {
+		logger.Println("ERR_ADMIN_STATS", err)
+		http.Error(w, "STATS ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	repoStatsMu.Lock()
+	perRepo := make(map[string]repoStat, len(repoStats))
+	for repo, c := range repoStats {
+		perRepo[repo] = repoStat{Hits: c.hits, Misses: c.misses}
+	}
+	repoStatsMu.Unlock()
+
+	resp := statsResponse{
+		TotalBytes: totalBytes,
+		EntryCount: entryCount,
+		Hits:       atomic.LoadInt64(&hitCount),
+		Misses:     atomic.LoadInt64(&missCount),
+		PerRepo:    perRepo,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logger.Println("ERR_ADMIN_STATS_ENCODE", err)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// gitInfoRefsTTL bounds how long a cached info/refs advertisement is served
+// before upstream is re-consulted, mirroring goModShortTTL: refs move every
+// time someone pushes, so this only needs to be "briefly" fresh.
+const gitInfoRefsTTL = 1 * time.Minute
+
+// gitInfoRefsPath is the cache key used for a repo's git-upload-pack
+// advertisement. The "?service=..." query string is not part of it since
+// this proxy only ever forwards git-upload-pack (read-only clone/fetch),
+// never git-receive-pack (push).
+const gitInfoRefsPath = "info/refs"
+
+// gitBackend implements RepoBackend for a git smart-HTTP upstream, but only
+// for the info/refs advertisement: the git-upload-pack negotiation itself is
+// a stateful POST with a client-specific body, so it is handled directly by
+// proxyGitUploadPack rather than through Fetch/Validators.
+type gitBackend struct {
+	remoteBase string
+}
+
+func (b *gitBackend) url(path string) string {
+	return fmt.Sprintf("%s/%s", b.remoteBase, path)
+}
+
+// Validators always reports "unknown": git-upload-pack advertisements don't
+// carry an ETag or Last-Modified, so freshness here is governed entirely by
+// gitInfoRefsTTL rather than conditional requests.
+func (b *gitBackend) Validators(ctx context.Context, path string) (etag, lastMod string, size int64, err error) {
+	return "", "", 0, nil
+}
+
+func (b *gitBackend) Fetch(ctx context.Context, path, ifNoneMatch, ifModifiedSince string) (*BackendResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.url(path)+"?service=git-upload-pack", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	return &BackendResponse{
+		Body:        resp.Body,
+		StatusCode:  resp.StatusCode,
+		ContentType: resp.Header.Get("Content-Type"),
+		Header:      resp.Header,
+	}, nil
+}
+
+// handleGitRequest serves a repomap entry whose type is "git": the info/refs
+// advertisement is cached briefly through the same singleflight and lock
+// machinery every other backend uses, while the git-upload-pack negotiation
+// itself is proxied straight through since its request body (the client's
+// wants/haves) is unique to that one clone or fetch.
+func handleGitRequest(ctx context.Context, w http.ResponseWriter, r *http.Request, repoEntry *repoMapEntry, repoName, rest string) {
+	backend := backendFor(repoEntry).(*gitBackend)
+
+	switch {
+	case r.Method == http.MethodGet && rest == gitInfoRefsPath && r.URL.Query().Get("service") == "git-upload-pack":
+		serveGitInfoRefs(ctx, w, r, backend, repoName)
+	case r.Method == http.MethodPost && rest == "git-upload-pack":
+		proxyGitUploadPack(ctx, w, r, backend, repoName)
+	default:
+		logger.Println("ERR_GIT_BADPATH", repoName, r.Method, rest)
+		http.Error(w, "NOT FOUND", http.StatusNotFound)
+	}
+}
+
+// tryServeGitInfoRefsHit takes the per-object read lock and serves cachePath,
+// re-checking cacheFileCurrent under the lock since the caller's own check
+// ran unlocked and a GC sweep can evict the entry in that gap.
+func tryServeGitInfoRefsHit(ctx context.Context, w http.ResponseWriter, r *http.Request, repoName, cachePath string, item *cacheItem) bool {
+	readLock, lockErr := acquireObjectLock(cachePath, false)
+	if lockErr != nil {
+		logger.Println("WARN_LOCK", lockErr)
+	} else {
+		defer readLock.release()
+		if !cacheFileCurrent(cachePath, item.fileSize) {
+			return false
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+	cw := &countingResponseWriter{ResponseWriter: w}
+	serveCacheFile(ctx, cw, r, repoName, cachePath, item.lastMod, true)
+	recordHit(repoName)
+	recordCacheAccess(ctx, repoName, gitInfoRefsPath, cw.written)
+	return true
+}
+
+func serveGitInfoRefs(ctx context.Context, w http.ResponseWriter, r *http.Request, backend *gitBackend, repoName string) {
+	cachePath, err := prepareCacheDir(ctx, repoName, gitInfoRefsPath)
+	if err != nil {
+		logger.Println("ERR_PREPARECACHEPATH", err)
+		http.Error(w, "INTERNAL SERVER ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	if item, found := getCacheItem(ctx, repoName, gitInfoRefsPath); found && isFresh(item, gitInfoRefsTTL) && cacheFileCurrent(cachePath, item.fileSize) {
+		if tryServeGitInfoRefsHit(ctx, w, r, repoName, cachePath, item) {
+			return
+		}
+		logger.Println("INFO_CACHE_RACE_GC", repoName, gitInfoRefsPath)
+	}
+
+	logger.Println("INFO_GIT_MISS", repoName, gitInfoRefsPath)
+	recordMiss(repoName)
+
+	key := singleflightKey(repoName, gitInfoRefsPath)
+	v, err, _ := fetchGroup.Do(key, func() (interface{}, error) {
+		result, _, _, err := fetchAndCacheViaBackend(ctx, backend, repoName, gitInfoRefsPath, cachePath)
+		return result, err
+	})
+	if err != nil {
+		logger.Println("ERR_GIT_FETCH", err)
+		captureException(ctx, err)
+		http.Error(w, "FETCH ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	result := v.(*missResult)
+	if !result.cached {
+		logger.Println("INFO_GIT_LOCK_FALLBACK", repoName, gitInfoRefsPath)
+		streamWithoutCaching(ctx, w, repoName, backend.url(gitInfoRefsPath)+"?service=git-upload-pack", "application/x-git-upload-pack-advertisement")
+		return
+	}
+
+	readLock, lockErr := acquireObjectLock(cachePath, false)
+	if lockErr != nil {
+		logger.Println("WARN_LOCK", lockErr)
+	} else {
+		defer readLock.release()
+	}
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+	cw := &countingResponseWriter{ResponseWriter: w}
+	serveCacheFile(ctx, cw, r, repoName, cachePath, "", false)
+	recordCacheAccess(ctx, repoName, gitInfoRefsPath, cw.written)
+}
+
+// proxyGitUploadPack forwards the client's want/have negotiation straight to
+// upstream and streams the pack response straight back, uncached: unlike
+// info/refs, every git-upload-pack POST body is unique to the clone or fetch
+// that sent it, so there is nothing here a second client could reuse.
+func proxyGitUploadPack(ctx context.Context, w http.ResponseWriter, r *http.Request, backend *gitBackend, repoName string) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, backend.url("git-upload-pack"), r.Body)
+	if err != nil {
+		logger.Println("ERR_GIT_UPLOADPACK_REQ", err)
+		http.Error(w, "INTERNAL SERVER ERROR", http.StatusInternalServerError)
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	if enc := r.Header.Get("Content-Encoding"); enc != "" {
+		req.Header.Set("Content-Encoding", enc)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		logger.Println("ERR_GIT_UPLOADPACK_FETCH", err)
+		http.Error(w, "FETCH ERROR", http.StatusInternalServerError)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		http.Error(w, fmt.Sprintf("UPSTREAM ERROR %s", resp.Status), resp.StatusCode)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+	if _, err := copyStream(ctx, "git.upload-pack", w, resp.Body, repoName, false, resp.StatusCode); err != nil {
+		logger.Println("ERR_GIT_UPLOADPACK_STREAM", err)
+	}
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Values of the repomap.type column. repoTypeRaw is the original implicit
+// behavior for every pre-existing row; repoTypeGoMod opts a repo into the
+// https://proxy.golang.org module proxy protocol on top of the same cache.
+const (
+	repoTypeRaw   = "raw"
+	repoTypeGoMod = "gomod"
+)
+
+// goModShortTTL bounds how long a mutable @v/list or @latest response is
+// served from cache before upstream is re-consulted. Resolved .info/.mod/.zip
+// responses are immutable and, once verified, never expire.
+const goModShortTTL = 1 * time.Minute
+
+// goModKind identifies which of the module proxy protocol's four endpoint
+// shapes a request matched.
+type goModKind int
+
+const (
+	goModList goModKind = iota
+	goModLatest
+	goModInfo
+	goModMod
+	goModZip
+)
+
+// immutable reports whether kind's response is keyed by an exact resolved
+// version and therefore never needs revalidation once cached, unlike
+// @v/list and @latest which can change as new versions are published.
+func (k goModKind) immutable() bool {
+	return k == goModInfo || k == goModMod || k == goModZip
+}
+
+// contentType is the Content-Type this endpoint shape serves. Every handler
+// (pass-through, cache hit and cache miss) sets it explicitly, since these
+// paths have no file extension for http.ServeContent to sniff from.
+func (k goModKind) contentType() string {
+	switch k {
+	case goModZip:
+		return "application/zip"
+	case goModInfo, goModLatest:
+		return "application/json"
+	default:
+		return "text/plain; charset=UTF-8"
+	}
+}
+
+// parseGoModPath splits the part of the URL after the repo name into a
+// module path and the endpoint it targets, per the four shapes proxy.golang.org
+// defines: @v/list, @latest, @v/<version>.info, @v/<version>.mod and
+// @v/<version>.zip.
+func parseGoModPath(rest string) (modulePath string, kind goModKind, version string, ok bool) {
+	if strings.HasSuffix(rest, "/@latest") {
+		return strings.TrimSuffix(rest, "/@latest"), goModLatest, "", true
+	}
+	idx := strings.LastIndex(rest, "/@v/")
+	if idx < 0 {
+		return "", 0, "", false
+	}
+	modulePath = rest[:idx]
+	suffix := rest[idx+len("/@v/"):]
+	switch {
+	case suffix == "list":
+		return modulePath, goModList, "", true
+	case strings.HasSuffix(suffix, ".info"):
+		return modulePath, goModInfo, strings.TrimSuffix(suffix, ".info"), true
+	case strings.HasSuffix(suffix, ".mod"):
+		return modulePath, goModMod, strings.TrimSuffix(suffix, ".mod"), true
+	case strings.HasSuffix(suffix, ".zip"):
+		return modulePath, goModZip, strings.TrimSuffix(suffix, ".zip"), true
+	default:
+		return "", 0, "", false
+	}
+}
+
+// encodeModulePath applies the proxy protocol's "case encoding" (each
+// uppercase letter becomes '!' followed by its lowercase form) so module
+// paths with mixed-case import paths round-trip through the sumdb's
+// case-insensitive-filesystem-safe URLs.
+func encodeModulePath(modulePath string) string {
+	var b strings.Builder
+	for _, r := range modulePath {
+		if r >= 'A' && r <= 'Z' {
+			b.WriteByte('!')
+			b.WriteRune(r - 'A' + 'a')
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// decodeModulePath reverses encodeModulePath's case encoding, turning a
+// request path's escaped form (e.g. "github.com/!burnt!sushi/toml") back
+// into the real import path ("github.com/BurntSushi/toml") for comparison
+// against sumdb lookup results, which are recorded under the real casing.
+func decodeModulePath(escaped string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(escaped); i++ {
+		c := escaped[i]
+		if c != '!' {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		if i >= len(escaped) {
+			return "", fmt.Errorf("module path %q ends with a bare '!'", escaped)
+		}
+		b.WriteByte(escaped[i] - 'a' + 'A')
+	}
+	return b.String(), nil
+}
+
+// sumdbBaseURL returns the sum database to verify .zip downloads against.
+// Set SUMDB_URL to point at a private sumdb, or GONOSUMCHECK=1 to disable
+// verification entirely.
+func sumdbBaseURL() string {
+	if os.Getenv("GONOSUMCHECK") != "" {
+		return ""
+	}
+	if v := os.Getenv("SUMDB_URL"); v != "" {
+		return strings.TrimSuffix(v, "/")
+	}
+	return "https://sum.golang.org"
+}
+
+// handleGoModRequest serves a repomap entry whose type is "gomod", applying
+// the protocol's caching rules: @v/list and @latest are short-TTL, while a
+// resolved version's .info/.mod/.zip are cached forever once fetched (and,
+// for .zip, verified against sumdb).
+func handleGoModRequest(ctx context.Context, w http.ResponseWriter, r *http.Request, repoEntry *repoMapEntry, repoName, rest string) {
+	modulePath, kind, version, ok := parseGoModPath(rest)
+	if !ok {
+		logger.Println("ERR_GOMOD_BADPATH", repoName, rest)
+		http.Error(w, "NOT FOUND", http.StatusNotFound)
+		return
+	}
+
+	remoteBase := strings.TrimSuffix(repoEntry.baseURL, "/")
+	targetUrl := fmt.Sprintf("%s/%s", remoteBase, rest)
+
+	cachePath, err := prepareCacheDir(ctx, repoName, rest)
+	if err != nil {
+		logger.Println("ERR_PREPARECACHEPATH", err)
+		http.Error(w, "INTERNAL SERVER ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	if kind.immutable() {
+		serveImmutableGoModObject(ctx, w, r, repoName, modulePath, version, rest, targetUrl, cachePath, kind)
+		return
+	}
+	serveMutableGoModObject(ctx, w, r, repoName, rest, targetUrl, cachePath, kind)
+}
+
+// tryServeImmutableGoModHit takes the per-object read lock and serves
+// cachePath, re-checking cacheFileCurrent under the lock since the caller's
+// own check ran unlocked and a GC sweep can evict the entry in that gap.
+func tryServeImmutableGoModHit(ctx context.Context, w http.ResponseWriter, r *http.Request, repoName, itemPath, cachePath string, item *cacheItem, kind goModKind) bool {
+	readLock, lockErr := acquireObjectLock(cachePath, false)
+	if lockErr != nil {
+		logger.Println("WARN_LOCK", lockErr)
+	} else {
+		defer readLock.release()
+		if !cacheFileCurrent(cachePath, item.fileSize) {
+			return false
+		}
+	}
+	if kind == goModZip && item.sumHash != "" {
+		w.Header().Set("ETag", quoteEtag(item.sumHash))
+	}
+	w.Header().Set("Content-Type", kind.contentType())
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	cw := &countingResponseWriter{ResponseWriter: w}
+	serveCacheFile(ctx, cw, r, repoName, cachePath, item.lastMod, true)
+	recordHit(repoName)
+	recordCacheAccess(ctx, repoName, itemPath, cw.written)
+	return true
+}
+
+// serveImmutableGoModObject serves a resolved .info/.mod/.zip entry from
+// cache without ever revalidating it, fetching and (for .zip) verifying it
+// against sumdb on a miss.
+func serveImmutableGoModObject(ctx context.Context, w http.ResponseWriter, r *http.Request, repoName, modulePath, version, itemPath, targetUrl, cachePath string, kind goModKind) {
+	if item, found := getCacheItem(ctx, repoName, itemPath); found && cacheFileCurrent(cachePath, item.fileSize) {
+		if tryServeImmutableGoModHit(ctx, w, r, repoName, itemPath, cachePath, item, kind) {
+			return
+		}
+		logger.Println("INFO_CACHE_RACE_GC", repoName, itemPath)
+	}
+
+	logger.Println("INFO_GOMOD_MISS", repoName, itemPath)
+	recordMiss(repoName)
+
+	key := singleflightKey(repoName, itemPath)
+	v, err, _ := fetchGroup.Do(key, func() (interface{}, error) {
+		return fetchAndCacheGoModObject(ctx, repoName, modulePath, version, itemPath, targetUrl, cachePath, kind)
+	})
+	if err != nil {
+		logger.Println("ERR_GOMOD_FETCH", err)
+		captureException(ctx, err)
+		http.Error(w, "FETCH ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	result := v.(*missResult)
+	if !result.cached {
+		logger.Println("INFO_GOMOD_LOCK_FALLBACK", repoName, itemPath)
+		streamWithoutCaching(ctx, w, repoName, targetUrl, kind.contentType())
+		return
+	}
+
+	readLock, lockErr := acquireObjectLock(cachePath, false)
+	if lockErr != nil {
+		logger.Println("WARN_LOCK", lockErr)
+	} else {
+		defer readLock.release()
+	}
+	if item, found := getCacheItem(ctx, repoName, itemPath); found && kind == goModZip && item.sumHash != "" {
+		w.Header().Set("ETag", quoteEtag(item.sumHash))
+	}
+	w.Header().Set("Content-Type", kind.contentType())
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	cw := &countingResponseWriter{ResponseWriter: w}
+	serveCacheFile(ctx, cw, r, repoName, cachePath, "", false)
+	recordCacheAccess(ctx, repoName, itemPath, cw.written)
+}
+
+// tryServeMutableGoModHit takes the per-object read lock and serves
+// cachePath, re-checking cacheFileCurrent under the lock since the caller's
+// own check ran unlocked and a GC sweep can evict the entry in that gap.
+func tryServeMutableGoModHit(ctx context.Context, w http.ResponseWriter, r *http.Request, repoName, itemPath, cachePath string, item *cacheItem, kind goModKind) bool {
+	readLock, lockErr := acquireObjectLock(cachePath, false)
+	if lockErr != nil {
+		logger.Println("WARN_LOCK", lockErr)
+	} else {
+		defer readLock.release()
+		if !cacheFileCurrent(cachePath, item.fileSize) {
+			return false
+		}
+	}
+	w.Header().Set("Content-Type", kind.contentType())
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(goModShortTTL.Seconds())))
+	cw := &countingResponseWriter{ResponseWriter: w}
+	serveCacheFile(ctx, cw, r, repoName, cachePath, item.lastMod, true)
+	recordHit(repoName)
+	recordCacheAccess(ctx, repoName, itemPath, cw.written)
+	return true
+}
+
+// serveMutableGoModObject serves @v/list and @latest, which are cached for
+// only goModShortTTL before upstream is re-consulted.
+func serveMutableGoModObject(ctx context.Context, w http.ResponseWriter, r *http.Request, repoName, itemPath, targetUrl, cachePath string, kind goModKind) {
+	if item, found := getCacheItem(ctx, repoName, itemPath); found && isFresh(item, goModShortTTL) && cacheFileCurrent(cachePath, item.fileSize) {
+		if tryServeMutableGoModHit(ctx, w, r, repoName, itemPath, cachePath, item, kind) {
+			return
+		}
+		logger.Println("INFO_CACHE_RACE_GC", repoName, itemPath)
+	}
+
+	logger.Println("INFO_GOMOD_MISS", repoName, itemPath)
+	recordMiss(repoName)
+
+	key := singleflightKey(repoName, itemPath)
+	v, err, _ := fetchGroup.Do(key, func() (interface{}, error) {
+		return fetchAndCacheGoModObject(ctx, repoName, "", "", itemPath, targetUrl, cachePath, kind)
+	})
+	if err != nil {
+		logger.Println("ERR_GOMOD_FETCH", err)
+		captureException(ctx, err)
+		http.Error(w, "FETCH ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	result := v.(*missResult)
+	if !result.cached {
+		logger.Println("INFO_GOMOD_LOCK_FALLBACK", repoName, itemPath)
+		streamWithoutCaching(ctx, w, repoName, targetUrl, kind.contentType())
+		return
+	}
+
+	readLock, lockErr := acquireObjectLock(cachePath, false)
+	if lockErr != nil {
+		logger.Println("WARN_LOCK", lockErr)
+	} else {
+		defer readLock.release()
+	}
+	w.Header().Set("Content-Type", kind.contentType())
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(goModShortTTL.Seconds())))
+	cw := &countingResponseWriter{ResponseWriter: w}
+	serveCacheFile(ctx, cw, r, repoName, cachePath, "", false)
+	recordCacheAccess(ctx, repoName, itemPath, cw.written)
+}
+
+// fetchAndCacheGoModObject downloads targetUrl into cachePath, holding the
+// same per-object flock fetchAndCacheMiss uses so concurrent repoproxyd
+// processes cannot write the same entry twice. For a .zip it computes the
+// module's h1 dirhash and verifies it against sumdb before publishing;
+// mismatches are recorded to sumdb_failures and the entry is never
+// published. If the lock cannot be acquired in time it returns a non-cached
+// result so the caller falls back to an uncached pass-through.
+func fetchAndCacheGoModObject(ctx context.Context, repo, modulePath, version, itemPath, targetUrl, cachePath string, kind goModKind) (*missResult, error) {
+	lock, err := acquireObjectLock(cachePath, true)
+	if err != nil {
+		logger.Println("WARN_LOCK_TIMEOUT", err)
+		return &missResult{cached: false}, nil
+	}
+	defer lock.release()
+
+	if fi, statErr := os.Stat(cachePath); statErr == nil && fi.Size() > 0 {
+		// Another process already populated this entry while we waited.
+		return &missResult{cached: true}, nil
+	}
+
+	getReq, err := http.NewRequestWithContext(ctx, http.MethodGet, targetUrl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build upstream GET: %w", err)
+	}
+	respGet, err := httpClient.Do(getReq)
+	if err != nil {
+		return nil, fmt.Errorf("upstream GET failed: %w", err)
+	}
+	defer respGet.Body.Close()
+
+	if respGet.StatusCode >= http.StatusBadRequest {
+		return nil, fmt.Errorf("upstream error: %s", respGet.Status)
+	}
+
+	tmpPath := cachePath + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tmp cache file: %w", err)
+	}
+
+	n, err := copyStream(ctx, "cache.write", file, respGet.Body, repo, false, respGet.StatusCode)
+	if err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("failed to stream upstream body: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("failed to close tmp cache file: %w", err)
+	}
+
+	var sumHash string
+	if kind == goModZip {
+		hash, err := zipDirHash(tmpPath)
+		if err != nil {
+			os.Remove(tmpPath)
+			return nil, fmt.Errorf("failed to hash zip: %w", err)
+		}
+		if base := sumdbBaseURL(); base != "" {
+			verified, err := verifySumdb(ctx, base, modulePath, version, hash)
+			if err != nil {
+				os.Remove(tmpPath)
+				return nil, fmt.Errorf("sumdb lookup failed for %s@%s: %w", modulePath, version, err)
+			}
+			if !verified {
+				os.Remove(tmpPath)
+				if recErr := recordSumdbFailure(ctx, repo, modulePath, version, hash); recErr != nil {
+					logger.Println("ERR_SUMDB_RECORDFAILURE", recErr)
+				}
+				return nil, fmt.Errorf("sumdb mismatch for %s@%s: computed %s", modulePath, version, hash)
+			}
+		}
+		sumHash = hash
+	}
+
+	if err := os.Rename(tmpPath, cachePath); err != nil {
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("failed to publish cache file: %w", err)
+	}
+
+	lastMod := respGet.Header.Get("Last-Modified")
+	etag := strings.TrimPrefix(respGet.Header.Get("ETag"), "W/")
+	if err := updateCache(ctx, repo, itemPath, lastMod, n, etag, sumHash, kind.contentType()); err != nil {
+		logger.Println("ERR_UPDATECACHE", err)
+	}
+
+	return &missResult{cached: true}, nil
+}
+
+// zipDirHash computes the module zip's "h1:" content hash: the sha256 of
+// each file in the archive, written as go.sum-style "<hex sha256>  <name>"
+// lines sorted by name, then sha256'd and base64-encoded as a whole. This is
+// the same algorithm golang.org/x/mod/sumdb/dirhash uses for Hash1.
+func zipDirHash(zipPath string) (string, error) {
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open downloaded zip: %w", err)
+	}
+	defer zr.Close()
+
+	type fileDigest struct {
+		name string
+		sum  [sha256.Size]byte
+	}
+	digests := make([]fileDigest, 0, len(zr.File))
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			return "", fmt.Errorf("failed to open %s in zip: %w", f.Name, err)
+		}
+		h := sha256.New()
+		_, copyErr := io.Copy(h, rc)
+		rc.Close()
+		if copyErr != nil {
+			return "", fmt.Errorf("failed to hash %s in zip: %w", f.Name, copyErr)
+		}
+		var fd fileDigest
+		fd.name = f.Name
+		copy(fd.sum[:], h.Sum(nil))
+		digests = append(digests, fd)
+	}
+	sort.Slice(digests, func(i, j int) bool { return digests[i].name < digests[j].name })
+
+	listHash := sha256.New()
+	for _, fd := range digests {
+		fmt.Fprintf(listHash, "%x  %s\n", fd.sum, fd.name)
+	}
+	return "h1:" + base64.StdEncoding.EncodeToString(listHash.Sum(nil)), nil
+}
+
+// verifySumdb looks up modulePath@version in the sum database at base and
+// reports whether it lists gotHash as the module's hash. It checks the
+// plaintext hash line only, not the note's signature: this proxy's threat
+// model is a tampered upstream mirror, not a compromised sumdb reached over
+// TLS.
+func verifySumdb(ctx context.Context, base, modulePath, version, gotHash string) (bool, error) {
+	lookupUrl := fmt.Sprintf("%s/lookup/%s@%s", base, encodeModulePath(modulePath), version)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, lookupUrl, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("sumdb lookup returned %s", resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+
+	realPath, err := decodeModulePath(modulePath)
+	if err != nil {
+		return false, err
+	}
+	want := fmt.Sprintf("%s %s %s", realPath, version, gotHash)
+	for _, line := range strings.Split(string(body), "\n") {
+		if strings.TrimSpace(line) == want {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// recordSumdbFailure logs a hash mismatch to the sumdb_failures table so an
+// operator can see which upstream served a tampered or corrupted module zip.
+func recordSumdbFailure(ctx context.Context, repo, modulePath, version, gotHash string) error {
+	_, err := db.Exec(ctx, "INSERT INTO sumdb_failures (reponame, modulepath, version, gothash, detectedat) VALUES ($1, $2, $3, $4, NOW())", repo, modulePath, version, gotHash)
+	if err != nil {
+		return fmt.Errorf("failed to record sumdb failure: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseGoModPath(t *testing.T) {
+	cases := []struct {
+		rest       string
+		modulePath string
+		kind       goModKind
+		version    string
+		ok         bool
+	}{
+		{"github.com/!burnt!sushi/toml/@latest", "github.com/!burnt!sushi/toml", goModLatest, "", true},
+		{"github.com/pkg/errors/@v/list", "github.com/pkg/errors", goModList, "", true},
+		{"github.com/pkg/errors/@v/v0.9.1.info", "github.com/pkg/errors", goModInfo, "v0.9.1", true},
+		{"github.com/pkg/errors/@v/v0.9.1.mod", "github.com/pkg/errors", goModMod, "v0.9.1", true},
+		{"github.com/pkg/errors/@v/v0.9.1.zip", "github.com/pkg/errors", goModZip, "v0.9.1", true},
+		{"github.com/pkg/errors/@v/v0.9.1.exe", "", 0, "", false},
+		{"not-a-gomod-path", "", 0, "", false},
+	}
+	for _, c := range cases {
+		modulePath, kind, version, ok := parseGoModPath(c.rest)
+		if modulePath != c.modulePath || kind != c.kind || version != c.version || ok != c.ok {
+			t.Errorf("parseGoModPath(%q) = (%q, %v, %q, %v), want (%q, %v, %q, %v)",
+				c.rest, modulePath, kind, version, ok, c.modulePath, c.kind, c.version, c.ok)
+		}
+	}
+}
+
+func TestEncodeDecodeModulePath(t *testing.T) {
+	cases := []struct {
+		real    string
+		encoded string
+	}{
+		{"github.com/pkg/errors", "github.com/pkg/errors"},
+		{"github.com/BurntSushi/toml", "github.com/!burnt!sushi/toml"},
+		{"Azure/go-autorest", "!azure/go-autorest"},
+	}
+	for _, c := range cases {
+		if got := encodeModulePath(c.real); got != c.encoded {
+			t.Errorf("encodeModulePath(%q) = %q, want %q", c.real, got, c.encoded)
+		}
+		got, err := decodeModulePath(c.encoded)
+		if err != nil {
+			t.Fatalf("decodeModulePath(%q) returned error: %v", c.encoded, err)
+		}
+		if got != c.real {
+			t.Errorf("decodeModulePath(%q) = %q, want %q", c.encoded, got, c.real)
+		}
+	}
+}
+
+func TestDecodeModulePathBareBang(t *testing.T) {
+	if _, err := decodeModulePath("github.com/foo!"); err == nil {
+		t.Error("decodeModulePath with a trailing bare '!' should return an error")
+	}
+}
+
+func TestVerifySumdb(t *testing.T) {
+	const realPath = "github.com/BurntSushi/toml"
+	// encodedPath is what parseGoModPath actually hands verifySumdb: the
+	// case-encoded URL segment, not the real-cased import path.
+	const encodedPath = "github.com/!burnt!sushi/toml"
+	const version = "v1.2.1"
+	const hash = "h1:some+hash="
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wantUrlPath := "/lookup/" + encodeModulePath(encodedPath) + "@" + version
+		if r.URL.Path != wantUrlPath {
+			t.Errorf("sumdb lookup hit %q, want %q", r.URL.Path, wantUrlPath)
+		}
+		w.Write([]byte(realPath + " " + version + " " + hash + "\n"))
+	}))
+	defer srv.Close()
+
+	verified, err := verifySumdb(context.Background(), srv.URL, encodedPath, version, hash)
+	if err != nil {
+		t.Fatalf("verifySumdb returned error: %v", err)
+	}
+	if !verified {
+		t.Error("verifySumdb should have verified a matching hash line after decoding the case-encoded module path")
+	}
+
+	if verified, err := verifySumdb(context.Background(), srv.URL, encodedPath, version, "h1:wrong="); err != nil || verified {
+		t.Errorf("verifySumdb should reject a mismatched hash, got (%v, %v)", verified, err)
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ociManifestTTL bounds how long a cached manifest is served before upstream
+// is re-consulted: a tag can be repointed to a new digest at any time, so
+// this mirrors goModShortTTL rather than being cached forever like a blob.
+const ociManifestTTL = 1 * time.Minute
+
+// defaultOCIManifestAccept is sent when the client's own request carried no
+// Accept header, so the upstream registry doesn't fall back to a legacy
+// schema1 manifest.
+const defaultOCIManifestAccept = "application/vnd.oci.image.manifest.v1+json, application/vnd.oci.image.index.v1+json, application/vnd.docker.distribution.manifest.v2+json, application/vnd.docker.distribution.manifest.list.v2+json"
+
+// ociKind identifies which of the two Docker Registry v2 API shapes this
+// proxy translates a request matched.
+type ociKind int
+
+const (
+	ociManifest ociKind = iota
+	ociBlob
+)
+
+// parseOCIPath splits the part of the URL after the repo name into the
+// image name and reference, per the two Registry v2 API shapes this proxy
+// translates: /v2/<name>/manifests/<ref> and /v2/<name>/blobs/<digest>.
+func parseOCIPath(rest string) (name, reference string, kind ociKind, ok bool) {
+	rest = strings.TrimPrefix(rest, "v2/")
+	if idx := strings.LastIndex(rest, "/manifests/"); idx >= 0 {
+		return rest[:idx], rest[idx+len("/manifests/"):], ociManifest, true
+	}
+	if idx := strings.LastIndex(rest, "/blobs/"); idx >= 0 {
+		return rest[:idx], rest[idx+len("/blobs/"):], ociBlob, true
+	}
+	return "", "", 0, false
+}
+
+// ociBackend implements RepoBackend for an OCI/Docker Registry v2 upstream.
+type ociBackend struct {
+	remoteBase string
+}
+
+func (b *ociBackend) url(path string) string {
+	return fmt.Sprintf("%s/%s", b.remoteBase, path)
+}
+
+func (b *ociBackend) doFetch(ctx context.Context, method, path, ifNoneMatch, ifModifiedSince string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, b.url(path), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", defaultOCIManifestAccept)
+	if ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	if ifModifiedSince != "" {
+		req.Header.Set("If-Modified-Since", ifModifiedSince)
+	}
+	return httpClient.Do(req)
+}
+
+func (b *ociBackend) Validators(ctx context.Context, path string) (etag, lastMod string, size int64, err error) {
+	resp, err := b.doFetch(ctx, http.MethodHead, path, "", "")
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer resp.Body.Close()
+	size, _ = strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	return ociETag(resp.Header), "", size, nil
+}
+
+func (b *ociBackend) Fetch(ctx context.Context, path, ifNoneMatch, ifModifiedSince string) (*BackendResponse, error) {
+	resp, err := b.doFetch(ctx, http.MethodGet, path, ifNoneMatch, ifModifiedSince)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		return &BackendResponse{StatusCode: resp.StatusCode, NotModified: true}, nil
+	}
+
+	contentLength, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	return &BackendResponse{
+		Body:          resp.Body,
+		StatusCode:    resp.StatusCode,
+		ContentType:   resp.Header.Get("Content-Type"),
+		ContentLength: contentLength,
+		ETag:          ociETag(resp.Header),
+		Header:        resp.Header,
+	}, nil
+}
+
+// ociETag prefers the registry's Docker-Content-Digest, which stays stable
+// across re-tags of the same content, over a generic ETag.
+func ociETag(h http.Header) string {
+	if d := h.Get("Docker-Content-Digest"); d != "" {
+		return d
+	}
+	return strings.TrimPrefix(h.Get("ETag"), "W/")
+}
+
+// handleOCIRequest serves a repomap entry whose type is "oci": blobs are
+// content-addressed by digest and cached forever once fetched, manifests are
+// cached for ociManifestTTL since a tag can be repointed at any time, and a
+// 401 challenge from the registry is passed straight through so the client
+// can authenticate and retry, exactly as it would talking to the registry
+// directly.
+func handleOCIRequest(ctx context.Context, w http.ResponseWriter, r *http.Request, repoEntry *repoMapEntry, repoName, rest string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "METHOD NOT ALLOWED", http.StatusMethodNotAllowed)
+		return
+	}
+	_, _, kind, ok := parseOCIPath(rest)
+	if !ok {
+		logger.Println("ERR_OCI_BADPATH", repoName, rest)
+		http.Error(w, "NOT FOUND", http.StatusNotFound)
+		return
+	}
+
+	backend := backendFor(repoEntry).(*ociBackend)
+	cachePath, err := prepareCacheDir(ctx, repoName, rest)
+	if err != nil {
+		logger.Println("ERR_PREPARECACHEPATH", err)
+		http.Error(w, "INTERNAL SERVER ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	if kind == ociBlob {
+		serveImmutableOCIObject(ctx, w, r, backend, repoName, rest, cachePath)
+		return
+	}
+	serveMutableOCIManifest(ctx, w, r, backend, repoName, rest, cachePath)
+}
+
+// passThroughAuthChallenge forwards a registry's 401 challenge to the client
+// verbatim (including WWW-Authenticate) so an OCI/Docker client can obtain a
+// bearer token and retry.
+func passThroughAuthChallenge(w http.ResponseWriter, upErr *backendUpstreamError) {
+	if auth := upErr.header.Get("WWW-Authenticate"); auth != "" {
+		w.Header().Set("WWW-Authenticate", auth)
+	}
+	http.Error(w, "UNAUTHORIZED", http.StatusUnauthorized)
+}
+
+// serveImmutableOCIObject serves a blob from cache without ever
+// revalidating it, since it is addressed by its own digest.
+func serveImmutableOCIObject(ctx context.Context, w http.ResponseWriter, r *http.Request, backend *ociBackend, repoName, itemPath, cachePath string) {
+	if item, found := getCacheItem(ctx, repoName, itemPath); found && cacheFileCurrent(cachePath, item.fileSize) {
+		if tryServeImmutableOCIHit(ctx, w, r, repoName, itemPath, cachePath, item) {
+			return
+		}
+		logger.Println("INFO_CACHE_RACE_GC", repoName, itemPath)
+	}
+
+	logger.Println("INFO_OCI_MISS", repoName, itemPath)
+	recordMiss(repoName)
+
+	key := singleflightKey(repoName, itemPath)
+	v, err, _ := fetchGroup.Do(key, func() (interface{}, error) {
+		result, etag, contentType, err := fetchAndCacheViaBackend(ctx, backend, repoName, itemPath, cachePath)
+		if err != nil {
+			return nil, err
+		}
+		return ociFetchOutcome{result: result, etag: etag, contentType: contentType}, nil
+	})
+	if err != nil {
+		if upErr, ok := err.(*backendUpstreamError); ok && upErr.statusCode == http.StatusUnauthorized {
+			passThroughAuthChallenge(w, upErr)
+			return
+		}
+		logger.Println("ERR_OCI_FETCH", err)
+		captureException(ctx, err)
+		http.Error(w, "FETCH ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	outcome := v.(ociFetchOutcome)
+	if !outcome.result.cached {
+		logger.Println("INFO_OCI_LOCK_FALLBACK", repoName, itemPath)
+		streamWithoutCaching(ctx, w, repoName, backend.url(itemPath), "application/octet-stream")
+		return
+	}
+
+	readLock, lockErr := acquireObjectLock(cachePath, false)
+	if lockErr != nil {
+		logger.Println("WARN_LOCK", lockErr)
+	} else {
+		defer readLock.release()
+	}
+	contentType := outcome.contentType
+	if contentType == "" {
+		if item, found := getCacheItem(ctx, repoName, itemPath); found {
+			contentType = item.contentType
+		}
+	}
+	setOCIDigestHeader(ctx, w, repoName, itemPath, outcome.etag)
+	setContentTypeHeader(w, contentType, "application/octet-stream")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	cw := &countingResponseWriter{ResponseWriter: w}
+	serveCacheFile(ctx, cw, r, repoName, cachePath, "", false)
+	recordCacheAccess(ctx, repoName, itemPath, cw.written)
+}
+
+// tryServeImmutableOCIHit takes the per-object read lock and serves
+// cachePath, re-checking cacheFileCurrent under the lock since the caller's
+// own check ran unlocked and a GC sweep can evict the entry in that gap.
+func tryServeImmutableOCIHit(ctx context.Context, w http.ResponseWriter, r *http.Request, repoName, itemPath, cachePath string, item *cacheItem) bool {
+	readLock, lockErr := acquireObjectLock(cachePath, false)
+	if lockErr != nil {
+		logger.Println("WARN_LOCK", lockErr)
+	} else {
+		defer readLock.release()
+		if !cacheFileCurrent(cachePath, item.fileSize) {
+			return false
+		}
+	}
+	if item.etag != "" {
+		w.Header().Set("Docker-Content-Digest", item.etag)
+	}
+	setContentTypeHeader(w, item.contentType, "application/octet-stream")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	cw := &countingResponseWriter{ResponseWriter: w}
+	serveCacheFile(ctx, cw, r, repoName, cachePath, item.lastMod, true)
+	recordHit(repoName)
+	recordCacheAccess(ctx, repoName, itemPath, cw.written)
+	return true
+}
+
+// ociFetchOutcome carries fetchAndCacheViaBackend's result alongside the
+// upstream ETag and Content-Type it just observed, so a cache-miss response
+// can set Docker-Content-Digest and Content-Type without a second
+// getCacheItem round trip.
+type ociFetchOutcome struct {
+	result      *missResult
+	etag        string
+	contentType string
+}
+
+// setOCIDigestHeader sets Docker-Content-Digest from etag when the caller's
+// own fetch already has it; otherwise (another process populated the entry
+// while this request waited on the lock) it falls back to a DB lookup.
+func setOCIDigestHeader(ctx context.Context, w http.ResponseWriter, repoName, itemPath, etag string) {
+	if etag != "" {
+		w.Header().Set("Docker-Content-Digest", etag)
+		return
+	}
+	if item, found := getCacheItem(ctx, repoName, itemPath); found && item.etag != "" {
+		w.Header().Set("Docker-Content-Digest", item.etag)
+	}
+}
+
+// setContentTypeHeader sets Content-Type to contentType, or fallback if the
+// upstream never sent one (neither registries nor http.ServeContent have
+// anything better to go on for a digest- or tag-addressed path).
+func setContentTypeHeader(w http.ResponseWriter, contentType, fallback string) {
+	if contentType == "" {
+		contentType = fallback
+	}
+	w.Header().Set("Content-Type", contentType)
+}
+
+// tryServeMutableOCIHit takes the per-object read lock and serves cachePath,
+// re-checking cacheFileCurrent under the lock since the caller's own check
+// ran unlocked and a GC sweep can evict the entry in that gap.
+func tryServeMutableOCIHit(ctx context.Context, w http.ResponseWriter, r *http.Request, repoName, itemPath, cachePath string, item *cacheItem) bool {
+	readLock, lockErr := acquireObjectLock(cachePath, false)
+	if lockErr != nil {
+		logger.Println("WARN_LOCK", lockErr)
+	} else {
+		defer readLock.release()
+		if !cacheFileCurrent(cachePath, item.fileSize) {
+			return false
+		}
+	}
+	if item.etag != "" {
+		w.Header().Set("Docker-Content-Digest", item.etag)
+	}
+	setContentTypeHeader(w, item.contentType, "application/vnd.oci.image.manifest.v1+json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(ociManifestTTL.Seconds())))
+	cw := &countingResponseWriter{ResponseWriter: w}
+	serveCacheFile(ctx, cw, r, repoName, cachePath, item.lastMod, true)
+	recordHit(repoName)
+	recordCacheAccess(ctx, repoName, itemPath, cw.written)
+	return true
+}
+
+// serveMutableOCIManifest serves a manifest, which is cached for only
+// ociManifestTTL before upstream is re-consulted.
+func serveMutableOCIManifest(ctx context.Context, w http.ResponseWriter, r *http.Request, backend *ociBackend, repoName, itemPath, cachePath string) {
+	if item, found := getCacheItem(ctx, repoName, itemPath); found && isFresh(item, ociManifestTTL) && cacheFileCurrent(cachePath, item.fileSize) {
+		if tryServeMutableOCIHit(ctx, w, r, repoName, itemPath, cachePath, item) {
+			return
+		}
+		logger.Println("INFO_CACHE_RACE_GC", repoName, itemPath)
+	}
+
+	logger.Println("INFO_OCI_MISS", repoName, itemPath)
+	recordMiss(repoName)
+
+	key := singleflightKey(repoName, itemPath)
+	v, err, _ := fetchGroup.Do(key, func() (interface{}, error) {
+		result, etag, contentType, err := fetchAndCacheViaBackend(ctx, backend, repoName, itemPath, cachePath)
+		if err != nil {
+			return nil, err
+		}
+		return ociFetchOutcome{result: result, etag: etag, contentType: contentType}, nil
+	})
+	if err != nil {
+		if upErr, ok := err.(*backendUpstreamError); ok && upErr.statusCode == http.StatusUnauthorized {
+			passThroughAuthChallenge(w, upErr)
+			return
+		}
+		logger.Println("ERR_OCI_FETCH", err)
+		captureException(ctx, err)
+		http.Error(w, "FETCH ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	outcome := v.(ociFetchOutcome)
+	if !outcome.result.cached {
+		logger.Println("INFO_OCI_LOCK_FALLBACK", repoName, itemPath)
+		streamWithoutCaching(ctx, w, repoName, backend.url(itemPath), "application/vnd.oci.image.manifest.v1+json")
+		return
+	}
+
+	readLock, lockErr := acquireObjectLock(cachePath, false)
+	if lockErr != nil {
+		logger.Println("WARN_LOCK", lockErr)
+	} else {
+		defer readLock.release()
+	}
+	contentType := outcome.contentType
+	if contentType == "" {
+		if item, found := getCacheItem(ctx, repoName, itemPath); found {
+			contentType = item.contentType
+		}
+	}
+	setOCIDigestHeader(ctx, w, repoName, itemPath, outcome.etag)
+	setContentTypeHeader(w, contentType, "application/vnd.oci.image.manifest.v1+json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(ociManifestTTL.Seconds())))
+	cw := &countingResponseWriter{ResponseWriter: w}
+	serveCacheFile(ctx, cw, r, repoName, cachePath, "", false)
+	recordCacheAccess(ctx, repoName, itemPath, cw.written)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultChunkThresholdBytes = 32 * 1024 * 1024
+	defaultChunkSizeBytes      = 8 * 1024 * 1024
+	defaultFetchConcurrency    = 4
+	maxChunkRetries            = 5
+)
+
+// chunkThresholdBytes is the object size above which chunkedFetch is used
+// instead of a single streaming GET.
+func chunkThresholdBytes() int64 {
+	if v := os.Getenv("CHUNK_THRESHOLD_BYTES"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			return n
+		}
+	}
+	return defaultChunkThresholdBytes
+}
+
+// fetchConcurrency bounds how many chunk GETs chunkedFetch runs at once.
+func fetchConcurrency() int {
+	if v := os.Getenv("FETCH_CONCURRENCY"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+	}
+	return defaultFetchConcurrency
+}
+
+// chunkedFetch downloads targetUrl into a pre-allocated sparse file at
+// tmpPath using concurrent Range GETs, inspired by the actions-cache chunk
+// uploader. It is only used for objects above chunkThresholdBytes whose
+// upstream advertised Accept-Ranges support. The caller is responsible for
+// only publishing the resulting file once chunkedFetch returns success.
+func chunkedFetch(ctx context.Context, targetUrl, tmpPath string, totalSize int64) error {
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create tmp cache file: %w", err)
+	}
+	defer file.Close()
+
+	if err := file.Truncate(totalSize); err != nil {
+		return fmt.Errorf("failed to preallocate sparse file: %w", err)
+	}
+
+	chunkSize := int64(defaultChunkSizeBytes)
+	numChunks := int((totalSize + chunkSize - 1) / chunkSize)
+
+	sem := make(chan struct{}, fetchConcurrency())
+	var wg sync.WaitGroup
+	errs := make([]error, numChunks)
+
+	for i := 0; i < numChunks; i++ {
+		start := int64(i) * chunkSize
+		end := start + chunkSize - 1
+		if end >= totalSize {
+			end = totalSize - 1
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(idx int, start, end int64) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[idx] = fetchChunkWithRetry(ctx, targetUrl, file, start, end)
+		}(i, start, end)
+	}
+	wg.Wait()
+
+	for _, chunkErr := range errs {
+		if chunkErr != nil {
+			return chunkErr
+		}
+	}
+	return nil
+}
+
+// fetchChunkWithRetry fetches a single byte range, retrying with exponential
+// backoff before giving up and failing the whole fetch.
+func fetchChunkWithRetry(ctx context.Context, targetUrl string, file *os.File, start, end int64) error {
+	var lastErr error
+	backoff := 250 * time.Millisecond
+	for attempt := 0; attempt < maxChunkRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if err := fetchChunk(ctx, targetUrl, file, start, end); err != nil {
+			lastErr = err
+			continue
+		}
+		return nil
+	}
+	return fmt.Errorf("chunk %d-%d failed after %d attempts: %w", start, end, maxChunkRetries, lastErr)
+}
+
+func fetchChunk(ctx context.Context, targetUrl string, file *os.File, start, end int64) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, targetUrl, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("expected 206 for range request, got %s", resp.Status)
+	}
+
+	want := end - start + 1
+	n, err := io.Copy(&sectionWriter{file: file, offset: start}, resp.Body)
+	if err != nil {
+		return err
+	}
+	if n != want {
+		return fmt.Errorf("short chunk read: got %d bytes, want %d", n, want)
+	}
+	return nil
+}
+
+// sectionWriter adapts os.File.WriteAt to io.Writer so io.Copy can stream a
+// chunk response body directly into its slot in the sparse cache file.
+type sectionWriter struct {
+	file   *os.File
+	offset int64
+}
+
+func (s *sectionWriter) Write(p []byte) (int, error) {
+	n, err := s.file.WriteAt(p, s.offset)
+	s.offset += int64(n)
+	return n, err
+}
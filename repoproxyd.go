@@ -3,15 +3,16 @@ package main
 import (
 	"context"
 	"fmt"
+	"github.com/exaring/otelpgx"
 	"github.com/getsentry/sentry-go"
-	"github.com/jackc/pgx/v4/pgxpool"
-	"io"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
 	"log"
 	"net/http"
 	"net/netip"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
 )
@@ -20,23 +21,35 @@ const (
 	defaultCacheDir = "/cache"
 )
 
+// sentryPlaceholderDSN is the un-substituted literal a local dev build or
+// `go test` sees: the real DSN is templated into sentryDSN by the deploy
+// pipeline before `go build` runs. Seeing the placeholder at init time means
+// no real DSN was ever substituted in, so Sentry reporting is skipped rather
+// than treated as a fatal misconfiguration.
+const sentryPlaceholderDSN = "<SENTRY_DSN>"
+
 var (
 	dsn        = os.Getenv("DSN")
+	sentryDSN  = sentryPlaceholderDSN
 	cacheDir   string
 	logger     *log.Logger
 	db         *pgxpool.Pool
-	httpClient = &http.Client{}
+	httpClient = &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
 )
 
 func init() {
-	err := sentry.Init(sentry.ClientOptions{
-		Dsn:              "<SENTRY_DSN>",
-		TracesSampleRate: 0.8,
-	})
-	if err != nil {
-		log.Fatalf("sentry.Init failed: %s", err)
+	if sentryDSN == sentryPlaceholderDSN {
+		log.Println("WARN_SENTRY_UNCONFIGURED: DSN was never substituted, skipping Sentry init")
+	} else {
+		err := sentry.Init(sentry.ClientOptions{
+			Dsn:              sentryDSN,
+			TracesSampleRate: 0.8,
+		})
+		if err != nil {
+			log.Fatalf("sentry.Init failed: %s", err)
+		}
+		defer sentry.Flush(2 * time.Second)
 	}
-	defer sentry.Flush(2 * time.Second)
 
 	cacheDir = os.Getenv("CACHE_DIR")
 	if cacheDir == "" {
@@ -44,39 +57,46 @@ func init() {
 	}
 
 	logger = log.New(os.Stdout, "[repoproxy] ", log.LstdFlags|log.Lmicroseconds)
+
+	dbCfg, errCfg := pgxpool.ParseConfig(dsn)
+	if errCfg != nil {
+		logger.Fatalf("Failed to parse DSN %s", errCfg)
+	}
+	dbCfg.ConnConfig.Tracer = otelpgx.NewTracer()
+
 	var errDB error
-	db, errDB = pgxpool.Connect(context.Background(), dsn)
+	db, errDB = pgxpool.NewWithConfig(context.Background(), dbCfg)
 	if errDB != nil {
 		logger.Fatalf("Failed to initiate DB %s", errDB)
 	}
 }
 
-func getRepoMap(repo string) (string, error) {
-	var baseURL string
-	err := db.QueryRow(context.Background(), "SELECT baseurl FROM repomap WHERE reponame = $1", repo).Scan(&baseURL)
-	if err != nil {
-		return "", fmt.Errorf("failed to query repomap: %w", err)
-	}
-	return baseURL, nil
+// repoMapEntry is a row of the repomap table. repoType selects the
+// RepoBackend (backend.go) mainHandler dispatches to: "raw"/"http" for a
+// plain file-tree mirror (the original implicit behavior, still the default
+// for pre-existing rows), "gomod" for the Go module proxy protocol,
+// "git" for a git smart-HTTP upstream, or "oci" for a Docker Registry v2
+// upstream.
+type repoMapEntry struct {
+	baseURL     string
+	ttlOverride *int64
+	repoType    string
 }
 
-func itemInCache(repo, itemPath, lastMod string, fileSize int64, etag string) (bool, error) {
-	var cachedLastMod string
-	var cachedFileSize int64
-	var cachedEtag string
-
-	err := db.QueryRow(context.Background(), "SELECT lastmodified, filesize, etag FROM cacheitem WHERE reponame = $1 AND pathname = $2", repo, itemPath).Scan(&cachedLastMod, &cachedFileSize, &cachedEtag)
+func getRepoMap(ctx context.Context, repo string) (*repoMapEntry, error) {
+	var entry repoMapEntry
+	err := db.QueryRow(ctx, "SELECT baseurl, ttlseconds, COALESCE(type, 'raw') FROM repomap WHERE reponame = $1", repo).Scan(&entry.baseURL, &entry.ttlOverride, &entry.repoType)
 	if err != nil {
-		return false, nil
-	}
-	if cachedLastMod == lastMod && cachedFileSize == fileSize && cachedEtag == etag {
-		return true, nil
-	} else {
-		return false, nil
+		return nil, fmt.Errorf("failed to query repomap: %w", err)
 	}
+	return &entry, nil
 }
 
-func updateCache(ctx context.Context, repo, itemPath, lastMod string, fileSize int64, etag string) error {
+// updateCache upserts a cacheitem row. sumHash is only meaningful for gomod
+// .zip entries (the verified "h1:..." dirhash); pass "" for everything else.
+// contentType is the upstream Content-Type observed for this fetch, so a
+// later cache hit can re-emit it (see cacheItem.contentType).
+func updateCache(ctx context.Context, repo, itemPath, lastMod string, fileSize int64, etag, sumHash, contentType string) error {
 	var count int
 	err := db.QueryRow(ctx, "SELECT COUNT(*) FROM cacheitem WHERE reponame = $1 AND pathname = $2", repo, itemPath).Scan(&count)
 	if err != nil {
@@ -91,11 +111,11 @@ func updateCache(ctx context.Context, repo, itemPath, lastMod string, fileSize i
 	}
 	defer tx.Rollback(ctx)
 	if count == 0 {
-		sqlStmt = "INSERT INTO cacheitem (reponame, pathname, lastmodified, filesize, etag, updatedate) VALUES ($1, $2, $3, $4, $5, NOW())"
-		_, err = tx.Exec(context.Background(), sqlStmt, repo, itemPath, lastMod, fileSize, etag)
+		sqlStmt = "INSERT INTO cacheitem (reponame, pathname, lastmodified, filesize, etag, sumhash, contenttype, updatedate, lastaccess, bytes_served) VALUES ($1, $2, $3, $4, $5, $6, $7, NOW(), NOW(), 0)"
+		_, err = tx.Exec(ctx, sqlStmt, repo, itemPath, lastMod, fileSize, etag, sumHash, contentType)
 	} else {
-		sqlStmt = "UPDATE cacheitem SET lastmodified = $1, filesize = $2, etag = $3, updatedate = NOW() WHERE reponame = $4 AND pathname = $5"
-		_, err = tx.Exec(context.Background(), sqlStmt, lastMod, fileSize, etag, repo, itemPath)
+		sqlStmt = "UPDATE cacheitem SET lastmodified = $1, filesize = $2, etag = $3, sumhash = $4, contenttype = $5, updatedate = NOW() WHERE reponame = $6 AND pathname = $7"
+		_, err = tx.Exec(ctx, sqlStmt, lastMod, fileSize, etag, sumHash, contentType, repo, itemPath)
 	}
 	err = tx.Commit(ctx)
 	if err != nil {
@@ -105,7 +125,10 @@ func updateCache(ctx context.Context, repo, itemPath, lastMod string, fileSize i
 	return nil
 }
 
-func prepareCacheDir(repo, itemPath string) (string, error) {
+func prepareCacheDir(ctx context.Context, repo, itemPath string) (string, error) {
+	_, span := tracer.Start(ctx, "prepareCacheDir")
+	defer span.End()
+
 	dirName := filepath.Dir(itemPath)
 	cacheDirFullPath := filepath.Join(cacheDir, repo, dirName)
 	err := os.MkdirAll(cacheDirFullPath, 0755)
@@ -137,101 +160,312 @@ func mainHandler(w http.ResponseWriter, r *http.Request) {
 	path := strings.SplitN(repoUrl, "/", 2)
 	repoName := path[0]
 	rest := path[1]
-	remoteBase, err := getRepoMap(repoName)
+	repoEntry, err := getRepoMap(ctx, repoName)
 	if err != nil {
 		logger.Println("ERR_GETREPOMAP", err)
-		sentry.CaptureException(err)
+		captureException(ctx, err)
 		http.Error(w, "NOT FOUND", http.StatusNotFound)
 		return
 	}
-	remoteBase = strings.TrimSuffix(remoteBase, "/")
-	targetUrl := fmt.Sprintf("%s/%s", remoteBase, rest)
-	respHead, err := httpClient.Head(targetUrl)
-	if err != nil {
-		logger.Println("ERR_HEAD", err)
-		http.Error(w, "INTERNAL SERVER ERROR", http.StatusInternalServerError)
+	switch repoEntry.repoType {
+	case repoTypeGoMod:
+		handleGoModRequest(ctx, w, r, repoEntry, repoName, rest)
+		return
+	case repoTypeGit:
+		handleGitRequest(ctx, w, r, repoEntry, repoName, rest)
+		return
+	case repoTypeOCI:
+		handleOCIRequest(ctx, w, r, repoEntry, repoName, rest)
 		return
-	}
-	defer respHead.Body.Close()
-	lastMod := respHead.Header.Get("Last-Modified")
-	contentLengthRaw := respHead.Header.Get("Content-Length")
-	contentLength, _ := strconv.ParseInt(contentLengthRaw, 10, 64)
-	etag := respHead.Header.Get("Etag")
-	mimeType := respHead.Header.Get("Content-Type")
-	if mimeType == "" {
-		mimeType = "application/octet-stream"
 	}
 
-	cachePath, err := prepareCacheDir(repoName, rest)
+	backend := backendFor(repoEntry).(*httpBackend)
+	targetUrl := backend.url(rest)
+	ttl := cacheTTLFor(repoEntry)
+
+	cachePath, err := prepareCacheDir(ctx, repoName, rest)
 	if err != nil {
 		logger.Println("ERR_PREPARECACHEPATH", err)
 	}
 
 	clientAddress := getClientIP(r)
-	inCache, _ := itemInCache(repoName, rest, lastMod, contentLength, etag)
 
-	if _, err := os.Stat(cachePath); !os.IsNotExist(err) && inCache {
-		http.ServeFile(w, r, cachePath)
+	if item, found := getCacheItem(ctx, repoName, rest); found {
+		if cacheFileCurrent(cachePath, item.fileSize) {
+			if isFresh(item, ttl) {
+				if tryServeCacheHit(ctx, w, r, repoName, rest, cachePath, item, ttl) {
+					return
+				}
+				logger.Println("INFO_CACHE_RACE_GC", repoName, rest)
+			} else {
+				logger.Println("INFO_CACHE_STALE_REVALIDATE", clientAddress, repoName, rest)
+				unchanged, revalErr := revalidateUpstream(ctx, backend, rest, item)
+				if revalErr != nil {
+					logger.Println("ERR_REVALIDATE", revalErr)
+				} else if unchanged {
+					if err := touchCacheUpdateDate(ctx, repoName, rest); err != nil {
+						logger.Println("ERR_TOUCHCACHE", err)
+					}
+					if tryServeCacheHit(ctx, w, r, repoName, rest, cachePath, item, ttl) {
+						return
+					}
+					logger.Println("INFO_CACHE_RACE_GC", repoName, rest)
+				}
+				// Object changed upstream (or revalidation failed): fall
+				// through to a full HEAD + fetch below, same as an ordinary
+				// cache miss.
+			}
+		}
+	}
+
+	head, err := backend.probeHead(ctx, rest)
+	if err != nil {
+		logger.Println("ERR_HEAD", err)
+		http.Error(w, "INTERNAL SERVER ERROR", http.StatusInternalServerError)
 		return
 	}
+	lastMod := head.lastMod
+	contentLength := head.contentLength
+	etag := head.etag
+	mimeType := head.contentType
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	acceptRanges := head.acceptRanges
 
 	logger.Println("INFO_CACHE_MISS", clientAddress, repoName, rest)
+	recordMiss(repoName)
 
-	respGet, err := httpClient.Get(targetUrl)
+	key := singleflightKey(repoName, rest)
+	v, err, _ := fetchGroup.Do(key, func() (interface{}, error) {
+		return fetchAndCacheMiss(ctx, backend, repoName, rest, targetUrl, cachePath, contentLength, lastMod, etag, mimeType, acceptRanges)
+	})
 	if err != nil {
-		logger.Println("ERR_GET", err)
+		logger.Println("ERR_FETCH", err)
 		http.Error(w, "FETCH ERROR", http.StatusInternalServerError)
 		return
 	}
-	defer respGet.Body.Close()
 
-	if respGet.StatusCode >= http.StatusBadRequest {
-		http.Error(w, fmt.Sprintf("UPSTREAM ERROR %s", respGet.Status), respGet.StatusCode)
+	result := v.(*missResult)
+	if !result.cached {
+		logger.Println("INFO_LOCK_FALLBACK", repoName, rest)
+		streamWithoutCaching(ctx, w, repoName, targetUrl, mimeType)
 		return
 	}
 
-	file, err := os.Create(cachePath)
+	readLock, lockErr := acquireObjectLock(cachePath, false)
+	if lockErr != nil {
+		logger.Println("WARN_LOCK", lockErr)
+	} else {
+		defer readLock.release()
+	}
+	w.Header().Set("Content-Type", mimeType)
+	if item, found := getCacheItem(ctx, repoName, rest); found {
+		setCacheValidatorHeaders(w, item.etag, item.lastMod, ttl)
+	}
+	// The upstream fetch above always pulled the full object, even if this
+	// request carried a Range header; now that cachePath is complete we can
+	// honor that Range (or serve the whole thing) from the on-disk copy.
+	cw := &countingResponseWriter{ResponseWriter: w}
+	serveCacheFile(ctx, cw, r, repoName, cachePath, lastMod, false)
+	recordCacheAccess(ctx, repoName, rest, cw.written)
+}
+
+// serveCacheFile serves a completed cache entry via http.ServeContent so
+// that Range, If-Range and multipart range requests are handled the same
+// way for both cache hits and post-fetch cache misses. The read is wrapped
+// in a span carrying the same attributes as copyStream's upstream-fetch
+// span (bytes served, repo, cache_hit) so a slow response can be attributed
+// to a slow disk read here rather than the fetch or DB steps upstream of it.
+func serveCacheFile(ctx context.Context, w http.ResponseWriter, r *http.Request, repo, cachePath, lastModHeader string, cacheHit bool) {
+	f, err := os.Open(cachePath)
 	if err != nil {
-		logger.Println("ERR_CREATECACHEPATH", err)
-		http.Error(w, "CACHE CREATE ERROR", http.StatusInternalServerError)
+		logger.Println("ERR_OPENCACHE", err)
+		http.Error(w, "CACHE READ ERROR", http.StatusInternalServerError)
 		return
 	}
-	defer file.Close()
+	defer f.Close()
 
-	logger.Println("DBG_HEAD", mimeType, contentLength)
-	respContentLastMod := respGet.Header.Get("Last-Modified")
-	respContentEtag := respGet.Header.Get("ETag")
-	respContentLengthRaw := respGet.Header.Get("Content-Length")
-	respContentLength, _ := strconv.ParseInt(respContentLengthRaw, 10, 64)
-	logger.Println("DBG_RESP", respContentLength, respContentLastMod)
-	w.Header().Set("Content-Type", mimeType)
-	_, err = io.Copy(io.MultiWriter(w, file), respGet.Body)
+	modTime, err := http.ParseTime(lastModHeader)
 	if err != nil {
-		logger.Println("ERR_STREAM", err)
-		return
+		modTime = time.Time{}
+	}
+
+	_, span := tracer.Start(ctx, "cache.read")
+	defer span.End()
+
+	var before int64
+	if cw, ok := w.(*countingResponseWriter); ok {
+		before = cw.written
 	}
 
-	if respContentLengthRaw == "" {
-		respContentLength = contentLength
+	http.ServeContent(w, r, filepath.Base(cachePath), modTime, f)
+
+	var written int64
+	if cw, ok := w.(*countingResponseWriter); ok {
+		written = cw.written - before
 	}
-	respContentEtag = strings.TrimPrefix(respContentEtag, "W/")
-	logger.Println("DBG_CACHEPAYLOAD", respContentLastMod, respContentLength, respContentEtag)
-	err = updateCache(ctx, repoName, rest, respContentLastMod, respContentLength, respContentEtag)
+	span.SetAttributes(
+		attribute.Int64("bytes_written", written),
+		attribute.Bool("cache_hit", cacheHit),
+		attribute.String("repo", repo),
+		attribute.Int("upstream_status", 0),
+	)
+}
+
+// missResult is the value shared by fetchGroup.Do among all goroutines
+// coalesced on the same repo+path key.
+type missResult struct {
+	cached bool
+}
+
+// fetchAndCacheMiss performs the upstream fetch for a cache miss and
+// publishes the result to cachePath, always pulling the full object even if
+// the triggering request carried a Range header (Range is served from the
+// completed cache file afterwards, never cached partially). It holds an
+// exclusive flock on cachePath+".lock" for the duration of the write so that
+// other repoproxyd processes sharing the same cache volume cannot write the
+// same entry concurrently. If the lock cannot be acquired before
+// lockWaitTimeout, it returns a non-cached result so the caller can fall
+// back to an uncached pass-through.
+func fetchAndCacheMiss(ctx context.Context, backend *httpBackend, repo, itemPath, targetUrl, cachePath string, headContentLength int64, headLastMod, headEtag, headContentType string, acceptRanges bool) (*missResult, error) {
+	lock, err := acquireObjectLock(cachePath, true)
 	if err != nil {
+		logger.Println("WARN_LOCK_TIMEOUT", err)
+		return &missResult{cached: false}, nil
+	}
+	defer lock.release()
+
+	if fi, statErr := os.Stat(cachePath); statErr == nil && fi.Size() > 0 {
+		// Another process already populated this entry while we waited.
+		return &missResult{cached: true}, nil
+	}
+
+	tmpPath := cachePath + ".tmp"
+
+	var finalLastMod, finalEtag, finalContentType string
+	var finalSize int64
+
+	if acceptRanges && headContentLength > chunkThresholdBytes() {
+		logger.Println("INFO_CHUNKED_FETCH", repo, itemPath, headContentLength)
+		if err := chunkedFetch(ctx, targetUrl, tmpPath, headContentLength); err != nil {
+			os.Remove(tmpPath)
+			return nil, fmt.Errorf("chunked fetch failed: %w", err)
+		}
+		finalLastMod, finalEtag, finalContentType, finalSize = headLastMod, headEtag, headContentType, headContentLength
+	} else {
+		resp, err := backend.Fetch(ctx, itemPath, "", "")
+		if err != nil {
+			return nil, fmt.Errorf("upstream fetch failed: %w", err)
+		}
+		if resp.Body != nil {
+			defer resp.Body.Close()
+		}
+		if resp.StatusCode >= http.StatusBadRequest {
+			return nil, fmt.Errorf("upstream error: %s", http.StatusText(resp.StatusCode))
+		}
+		if resp.Body == nil {
+			return nil, fmt.Errorf("upstream returned no body for %s", itemPath)
+		}
+
+		file, err := os.Create(tmpPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create tmp cache file: %w", err)
+		}
+
+		n, err := copyStream(ctx, "cache.write", file, resp.Body, repo, false, resp.StatusCode)
+		if err != nil {
+			file.Close()
+			os.Remove(tmpPath)
+			return nil, fmt.Errorf("failed to stream upstream body: %w", err)
+		}
+		if err := file.Close(); err != nil {
+			os.Remove(tmpPath)
+			return nil, fmt.Errorf("failed to close tmp cache file: %w", err)
+		}
+
+		finalLastMod = resp.LastModified
+		finalEtag = resp.ETag
+		finalContentType = resp.ContentType
+		finalSize = n
+	}
+
+	if err := os.Rename(tmpPath, cachePath); err != nil {
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("failed to publish cache file: %w", err)
+	}
+
+	logger.Println("DBG_CACHEPAYLOAD", finalLastMod, finalSize, finalEtag)
+	if err := updateCache(ctx, repo, itemPath, finalLastMod, finalSize, finalEtag, "", finalContentType); err != nil {
 		logger.Println("ERR_UPDATECACHE", err)
 	}
 
+	return &missResult{cached: true}, nil
+}
+
+// streamWithoutCaching is the degraded fallback used when the per-object
+// lock cannot be acquired in time: it proxies the upstream response straight
+// through to the client without touching the on-disk cache.
+func streamWithoutCaching(ctx context.Context, w http.ResponseWriter, repo, targetUrl, mimeType string) {
+	getReq, err := http.NewRequestWithContext(ctx, http.MethodGet, targetUrl, nil)
+	if err != nil {
+		logger.Println("ERR_GET_FALLBACK", err)
+		http.Error(w, "FETCH ERROR", http.StatusInternalServerError)
+		return
+	}
+	respGet, err := httpClient.Do(getReq)
+	if err != nil {
+		logger.Println("ERR_GET_FALLBACK", err)
+		http.Error(w, "FETCH ERROR", http.StatusInternalServerError)
+		return
+	}
+	defer respGet.Body.Close()
+
+	if respGet.StatusCode >= http.StatusBadRequest {
+		http.Error(w, fmt.Sprintf("UPSTREAM ERROR %s", respGet.Status), respGet.StatusCode)
+		return
+	}
+
+	// Prefer whatever upstream actually served over the caller's guess: for
+	// backends like OCI where mimeType is only a fallback default, upstream's
+	// own header may point at a different (but equally valid) media type,
+	// e.g. a manifest list instead of a single-arch manifest.
+	upstreamType := respGet.Header.Get("Content-Type")
+	if upstreamType == "" {
+		upstreamType = mimeType
+	}
+	w.Header().Set("Content-Type", upstreamType)
+	if _, err := copyStream(ctx, "cache.passthrough", w, respGet.Body, repo, false, respGet.StatusCode); err != nil {
+		logger.Println("ERR_STREAM_FALLBACK", err)
+	}
 }
 
 func main() {
-	http.HandleFunc("/r/", mainHandler)
+	shutdownTracing, err := initTracing(context.Background())
+	if err != nil {
+		logger.Fatalf("Failed to init tracing: %v", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Println("ERR_TRACING_SHUTDOWN", err)
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/r/", mainHandler)
+	mux.HandleFunc("/admin/gc", adminGCHandler)
+	mux.HandleFunc("/admin/stats", adminStatsHandler)
+
+	go startGCLoop(context.Background())
 
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "5000"
 	}
 	logger.Printf("Server listening on port %s", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
+	if err := http.ListenAndServe(":"+port, otelhttp.NewHandler(mux, "repoproxy")); err != nil {
 		logger.Fatalf("Failed to run server: %v", err)
 	}
 }
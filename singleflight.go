@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/sys/unix"
+)
+
+// fetchGroup coalesces concurrent cache misses for the same repo+path within
+// this process so only one goroutine performs the upstream fetch.
+var fetchGroup singleflight.Group
+
+// lockWaitTimeout bounds how long a request will wait to acquire the
+// per-object file lock before falling back to an uncached pass-through.
+const lockWaitTimeout = 30 * time.Second
+
+// objectLock is an flock(2)-backed lock on cachePath+".lock", mirroring the
+// approach used by the Go module cache to serialize writers across separate
+// repoproxyd processes sharing the same /cache volume.
+type objectLock struct {
+	file *os.File
+}
+
+// acquireObjectLock takes an exclusive (writer) or shared (reader) flock on
+// the lock file next to cachePath, waiting up to lockWaitTimeout. Callers
+// must call release() when done.
+func acquireObjectLock(cachePath string, exclusive bool) (*objectLock, error) {
+	lockPath := cachePath + ".lock"
+	f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	how := unix.LOCK_SH
+	if exclusive {
+		how = unix.LOCK_EX
+	}
+
+	deadline := time.Now().Add(lockWaitTimeout)
+	for {
+		err := unix.Flock(int(f.Fd()), how|unix.LOCK_NB)
+		if err == nil {
+			return &objectLock{file: f}, nil
+		}
+		if err != unix.EWOULDBLOCK {
+			f.Close()
+			return nil, fmt.Errorf("flock failed: %w", err)
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("timed out waiting for lock on %s", lockPath)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (l *objectLock) release() {
+	unix.Flock(int(l.file.Fd()), unix.LOCK_UN)
+	l.file.Close()
+}
+
+// singleflightKey returns the coordinator key for a repo+path pair.
+func singleflightKey(repo, itemPath string) string {
+	return repo + "|" + itemPath
+}
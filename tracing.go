@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/getsentry/sentry-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer is the package-wide span source for the request path. It is a
+// no-op until initTracing installs a real TracerProvider.
+var tracer = otel.Tracer("github.com/pakornchu/repoproxy")
+
+// initTracing builds an OTLP exporter selected by OTEL_EXPORTER_OTLP_PROTOCOL
+// ("grpc", the default, or "http/protobuf") and installs it as the global
+// TracerProvider. The returned shutdown func flushes and closes the exporter
+// and should be deferred from main.
+func initTracing(ctx context.Context) (shutdown func(context.Context) error, err error) {
+	var exporter sdktrace.SpanExporter
+	switch os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL") {
+	case "http/protobuf":
+		exporter, err = otlptracehttp.New(ctx)
+	default:
+		exporter, err = otlptracegrpc.New(ctx)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to build OTLP exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		semconv.ServiceName("repoproxy"),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build OTel resource: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+
+	return tp.Shutdown, nil
+}
+
+// captureException reports err to Sentry and, when ctx carries an active
+// span, tags the event with the trace ID so the Sentry issue links back to
+// the trace that produced it.
+func captureException(ctx context.Context, err error) {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		sentry.CaptureException(err)
+		return
+	}
+	sentry.WithScope(func(scope *sentry.Scope) {
+		scope.SetTag("trace_id", sc.TraceID().String())
+		sentry.CaptureException(err)
+	})
+}
+
+// copyStream wraps io.Copy in a span carrying the attributes needed to tell
+// apart a slow disk write from a slow upstream on a given request: how many
+// bytes moved, whether this was a cache hit, which repo it was for, and the
+// upstream status code that preceded the copy (0 when none applies, e.g. a
+// cache hit that never talked to upstream).
+func copyStream(ctx context.Context, spanName string, dst io.Writer, src io.Reader, repo string, cacheHit bool, upstreamStatus int) (int64, error) {
+	_, span := tracer.Start(ctx, spanName)
+	defer span.End()
+
+	n, err := io.Copy(dst, src)
+
+	span.SetAttributes(
+		attribute.Int64("bytes_written", n),
+		attribute.Bool("cache_hit", cacheHit),
+		attribute.String("repo", repo),
+		attribute.Int("upstream_status", upstreamStatus),
+	)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return n, err
+}